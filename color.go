@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// ANSI escapes used when --color is in effect, chosen to match GNU grep's
+// defaults.
+const (
+	colorFilename = "\x1b[35m"
+	colorLineNum  = "\x1b[32m"
+	colorMatch    = "\x1b[01;31m"
+	colorReset    = "\x1b[0m"
+)
+
+// Reports whether stdout looks like an interactive terminal, used to decide
+// --color=auto.
+func stdoutIsTerminal() bool {
+	return term.IsTerminal(int(os.Stdout.Fd()))
+}
+
+// Wraps match in the highlight color, if args.useColor is set.
+func colorizeMatch(args *options, match []byte) []byte {
+	if !args.useColor {
+		return match
+	}
+	out := make([]byte, 0, len(match)+len(colorMatch)+len(colorReset))
+	out = append(out, colorMatch...)
+	out = append(out, match...)
+	out = append(out, colorReset...)
+	return out
+}
+
+// Returns text with every span in spans wrapped in the highlight color. If
+// args.useColor is false or spans is empty, text is returned unchanged.
+func highlightSpans(args *options, text []byte, spans [][]int) []byte {
+	if !args.useColor || (len(spans) == 0) {
+		return text
+	}
+	var out []byte
+	prev := 0
+	for _, span := range spans {
+		out = append(out, text[prev:span[0]]...)
+		out = append(out, colorizeMatch(args, text[span[0]:span[1]])...)
+		prev = span[1]
+	}
+	out = append(out, text[prev:]...)
+	return out
+}
+
+// Builds the "filename:lineNumber:" (or any subset thereof, depending on
+// args) prefix for a single output line, colorizing the filename and line
+// number headers when args.useColor is set.
+func formatLinePrefix(args *options, filename string, lineNum int) string {
+	var b strings.Builder
+	if !args.hideFilenames {
+		if args.useColor {
+			b.WriteString(colorFilename)
+			b.WriteString(filename)
+			b.WriteString(colorReset)
+		} else {
+			b.WriteString(filename)
+		}
+		if args.lineNumbers {
+			b.WriteString(":")
+		} else {
+			b.WriteString(": ")
+		}
+	}
+	if args.lineNumbers {
+		numStr := strconv.Itoa(lineNum)
+		if args.useColor {
+			b.WriteString(colorLineNum)
+			b.WriteString(numStr)
+			b.WriteString(colorReset)
+		} else {
+			b.WriteString(numStr)
+		}
+		b.WriteString(": ")
+	}
+	return b.String()
+}
+
+// Prints one matchedLine's output. Under -o, every match span is printed on
+// its own line; otherwise the whole line is printed with matches
+// highlighted when color is enabled.
+func printMatchedLine(args *options, filename string, ml matchedLine) {
+	prefix := formatLinePrefix(args, filename, ml.number)
+	if args.onlyMatched && (len(ml.spans) > 0) {
+		for _, span := range ml.spans {
+			fmt.Printf("%s%s\n", prefix, colorizeMatch(args, ml.text[span[0]:span[1]]))
+		}
+		return
+	}
+	fmt.Printf("%s%s\n", prefix, highlightSpans(args, ml.text, ml.spans))
+}
+
+// Prints every line in lines, in order, inserting a "--" separator between
+// non-adjacent groups whenever context lines (-A/-B/-C) are in play. With no
+// context configured, every match is printed as before with no separators.
+func printMatchedLines(args *options, filename string, lines []matchedLine) {
+	usingContext := (args.beforeContext > 0) || (args.afterContext > 0)
+	prevNumber := 0
+	for i, ml := range lines {
+		if usingContext && (i > 0) && (ml.number != prevNumber+1) {
+			fmt.Println("--")
+		}
+		printMatchedLine(args, filename, ml)
+		prevNumber = ml.number
+	}
+}
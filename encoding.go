@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+)
+
+// How many bytes to read from the start of a file when sniffing its
+// encoding.
+const encodingSniffSampleSize = 4096
+
+// Maps the names accepted by -E to their decoders. A nil value means the
+// bytes are already UTF-8 and need no transform.
+var namedEncodings = map[string]encoding.Encoding{
+	"utf-8":       nil,
+	"utf-16le":    unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM),
+	"utf-16be":    unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM),
+	"sjis":        japanese.ShiftJIS,
+	"euc-jp":      japanese.EUCJP,
+	"iso-2022-jp": japanese.ISO2022JP,
+}
+
+// Byte-order-marks recognized before consulting args.encodings at all, most
+// specific prefix first so the two-byte UTF-16 marks don't shadow longer
+// ones.
+var bomPrefixes = []struct {
+	mark []byte
+	enc  encoding.Encoding
+}{
+	// wrapDecodedReader seeks past the BOM bytes itself, so these use
+	// IgnoreBOM decoders rather than ExpectBOM: by the time the decoder
+	// sees the stream, the mark is already gone.
+	{[]byte{0xEF, 0xBB, 0xBF}, nil},
+	{[]byte{0xFF, 0xFE}, unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM)},
+	{[]byte{0xFE, 0xFF}, unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM)},
+}
+
+// Splits a comma-separated -E argument into individual encoding names.
+func parseEncodingList(s string) []string {
+	parts := strings.Split(s, ",")
+	names := make([]string, 0, len(parts))
+	for _, p := range parts {
+		p = strings.TrimSpace(p)
+		if p != "" {
+			names = append(names, p)
+		}
+	}
+	return names
+}
+
+// Reports whether file starts with one of bomPrefixes, restoring file's
+// read position to the start afterward. Used by tryMmapForFile, which
+// otherwise never looks at file contents before deciding whether to mmap.
+func fileStartsWithBOM(file *os.File) (bool, error) {
+	maxLen := 0
+	for _, bom := range bomPrefixes {
+		if len(bom.mark) > maxLen {
+			maxLen = len(bom.mark)
+		}
+	}
+	sample := make([]byte, maxLen)
+	n, e := file.Read(sample)
+	if (e != nil) && (e != io.EOF) {
+		return false, e
+	}
+	sample = sample[:n]
+	if _, e = file.Seek(0, io.SeekStart); e != nil {
+		return false, e
+	}
+	for _, bom := range bomPrefixes {
+		if bytes.HasPrefix(sample, bom.mark) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Sniffs the start of file for a BOM, then for a sample that's already
+// valid UTF-8, then falls back to trying each encoding named in
+// args.encodings in order, picking the first that decodes the sample into
+// valid, mostly-unreplaced UTF-8. Returns the encoding to decode with (nil
+// means no transform is needed) and the number of leading BOM bytes to
+// skip. If file isn't seekable (e.g. a pipe), detection is skipped
+// entirely.
+func detectEncoding(args *options, file *os.File) (encoding.Encoding, int) {
+	// Probe seekability before reading anything: on a pipe, Read would
+	// consume bytes the caller still needs, and the later Seek back to the
+	// start would fail, silently dropping them.
+	if _, e := file.Seek(0, io.SeekCurrent); e != nil {
+		return nil, 0
+	}
+	sample := make([]byte, encodingSniffSampleSize)
+	n, e := file.Read(sample)
+	if (e != nil) && (e != io.EOF) {
+		return nil, 0
+	}
+	sample = sample[:n]
+	if _, e = file.Seek(0, io.SeekStart); e != nil {
+		return nil, 0
+	}
+	for _, bom := range bomPrefixes {
+		if bytes.HasPrefix(sample, bom.mark) {
+			return bom.enc, len(bom.mark)
+		}
+	}
+	// Plain ASCII and real UTF-8 text can also "cleanly" decode as
+	// UTF-16 or another multi-byte encoding by coincidence (an even
+	// number of ASCII bytes reads as valid, unreplaced CJK under
+	// UTF-16). Since valid UTF-8 never needs transcoding anyway, prefer
+	// it outright rather than letting a later, spurious guess win.
+	if utf8.Valid(sample) {
+		return nil, 0
+	}
+	for _, name := range args.encodings {
+		enc, ok := namedEncodings[strings.ToLower(name)]
+		if !ok || (enc == nil) {
+			continue
+		}
+		if decodesCleanly(enc, sample) {
+			return enc, 0
+		}
+	}
+	return nil, 0
+}
+
+// Reports whether decoding sample with enc produces valid UTF-8 with a low
+// ratio of replacement characters, which would indicate a wrong guess.
+func decodesCleanly(enc encoding.Encoding, sample []byte) bool {
+	decoded, _, e := transform.Bytes(enc.NewDecoder(), sample)
+	if (e != nil) || !utf8.Valid(decoded) {
+		return false
+	}
+	if len(decoded) == 0 {
+		return false
+	}
+	replacements := bytes.Count(decoded, []byte("�"))
+	return (replacements * 20) < len(decoded)
+}
+
+// Wraps file in a transform.Reader decoding it to UTF-8, if detectEncoding
+// determines that's necessary. Otherwise returns file unchanged. Leading
+// BOM bytes, if any, are skipped in either case.
+func wrapDecodedReader(args *options, file *os.File) (io.Reader, error) {
+	enc, bomLen := detectEncoding(args, file)
+	if bomLen > 0 {
+		if _, e := file.Seek(int64(bomLen), io.SeekStart); e != nil {
+			return nil, e
+		}
+	}
+	if enc == nil {
+		return file, nil
+	}
+	return transform.NewReader(file, enc.NewDecoder()), nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Returns the list of glob patterns which are excluded by default unless
+// --no-default-excludes is given. These cover common VCS metadata
+// directories, editor swap files, and build artifacts.
+func defaultExcludeGlobs() []string {
+	return []string{
+		".git",
+		".svn",
+		".hg",
+		"*.swp",
+		"*.swo",
+		"*.o",
+		"*.exe",
+		"*.a",
+	}
+}
+
+// Converts a bash-style glob pattern to a compiled regular expression,
+// supporting "*", "?", "[...]" character classes, "{a,b}" alternation, and
+// "/**/" (or a leading/trailing "**") to match zero or more path segments,
+// similar to "doublestar" glob semantics used by tools like ripgrep.
+func compileGlob(pattern string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString("^")
+	runes := []rune(pattern)
+	n := len(runes)
+	braceDepth := 0
+	for i := 0; i < n; i++ {
+		c := runes[i]
+		switch c {
+		case '*':
+			if (i+1 < n) && (runes[i+1] == '*') {
+				isLeading := (i == 0) || (runes[i-1] == '/')
+				j := i + 2
+				isTrailing := (j >= n) || (runes[j] == '/')
+				if isLeading && isTrailing {
+					switch {
+					case (i == 0) && (j >= n):
+						b.WriteString(".*")
+					case i == 0:
+						b.WriteString("(?:.*/)?")
+						j++
+					case j >= n:
+						// The "/" preceding this trailing "**" was already
+						// written as a literal; fold it into the optional
+						// group so "dir/**" matches "dir" and "dir/sub",
+						// not just a doubled slash.
+						trimmed := strings.TrimSuffix(b.String(), "/")
+						b.Reset()
+						b.WriteString(trimmed)
+						b.WriteString("(?:/.*)?")
+					default:
+						b.WriteString("(?:.*/)?")
+						j++
+					}
+					i = j - 1
+					continue
+				}
+			}
+			b.WriteString("[^/]*")
+		case '?':
+			b.WriteString("[^/]")
+		case '[':
+			j := i + 1
+			var cls strings.Builder
+			cls.WriteByte('[')
+			if (j < n) && ((runes[j] == '!') || (runes[j] == '^')) {
+				cls.WriteByte('^')
+				j++
+			}
+			for (j < n) && (runes[j] != ']') {
+				cls.WriteRune(runes[j])
+				j++
+			}
+			if j >= n {
+				// Unterminated bracket expression; treat the '[' literally.
+				b.WriteString(regexp.QuoteMeta("["))
+				continue
+			}
+			cls.WriteByte(']')
+			b.WriteString(cls.String())
+			i = j
+		case '{':
+			b.WriteString("(?:")
+			braceDepth++
+		case '}':
+			if braceDepth > 0 {
+				b.WriteString(")")
+				braceDepth--
+			} else {
+				b.WriteString(regexp.QuoteMeta("}"))
+			}
+		case ',':
+			if braceDepth > 0 {
+				b.WriteString("|")
+			} else {
+				b.WriteString(",")
+			}
+		case '.', '+', '(', ')', '|', '^', '$', '\\':
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	re, e := regexp.Compile(b.String())
+	if e != nil {
+		return nil, fmt.Errorf("Invalid glob pattern %q: %s", pattern, e)
+	}
+	return re, nil
+}
+
+// Compiles a list of glob patterns, returning an error naming the first
+// pattern that fails to compile.
+func compileGlobs(patterns []string) ([]*regexp.Regexp, error) {
+	compiled := make([]*regexp.Regexp, 0, len(patterns))
+	for _, p := range patterns {
+		re, e := compileGlob(p)
+		if e != nil {
+			return nil, e
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
+
+// Returns true if path is matched by any of the given compiled globs. Both
+// the full path and its basename are checked, so a pattern like "*.o" will
+// match regardless of which directory the file lives in.
+func matchesAnyGlob(globs []*regexp.Regexp, path string) bool {
+	if len(globs) == 0 {
+		return false
+	}
+	base := filepath.Base(path)
+	for _, g := range globs {
+		if g.MatchString(base) || g.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
@@ -5,45 +5,191 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
 	"fmt"
-	"io"
 	"os"
 	"path/filepath"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 )
 
 // Holds settings for how the program will run. If paths is nil or empty,
 // then the program should run on stdin.
 type options struct {
-	insensitive   bool
-	recursive     bool
-	inverse       bool
-	onlyMatched   bool
-	expression    string
-	binaryAsText  bool
-	hideFilenames bool
-	showFilenames bool
-	paths         []string
+	insensitive       bool
+	recursive         bool
+	inverse           bool
+	onlyMatched       bool
+	patternSpecs      []patternSpec
+	explicitPatterns  bool
+	binaryAsText      bool
+	hideFilenames     bool
+	showFilenames     bool
+	paths             []string
+	excludes          []string
+	includes          []string
+	noDefaultExcludes bool
+	excludeGlobs      []*regexp.Regexp
+	includeGlobs      []*regexp.Regexp
+	numWorkers        int
+	encodings         []string
+	lineNumbers       bool
+	colorMode         string
+	useColor          bool
+	beforeContext     int
+	afterContext      int
+	forceMmap         bool
+	noMmap            bool
+}
+
+// Returns true if path should be skipped due to the configured exclude
+// globs (including the built-in defaults, unless disabled).
+func (a *options) isExcluded(path string) bool {
+	return matchesAnyGlob(a.excludeGlobs, path)
+}
+
+// Returns true if path is allowed by the configured include globs. If no
+// include globs were given, everything is included.
+func (a *options) isIncluded(path string) bool {
+	if len(a.includeGlobs) == 0 {
+		return true
+	}
+	return matchesAnyGlob(a.includeGlobs, path)
 }
 
 func parseArgs() (*options, error) {
 	var toReturn options
 	var e error
-	flagsRegex := regexp.MustCompile(`^-([irvahHo]+)$`)
+	flagsRegex := regexp.MustCompile(`^-([irvahHon]+)$`)
 	pathIndex := -1
-	for i, arg := range os.Args[1:] {
+	rawArgs := os.Args[1:]
+	for i := 0; i < len(rawArgs); i++ {
+		arg := rawArgs[i]
 		if arg == "--help" {
 			help()
 		}
+		if arg == "--no-default-excludes" {
+			toReturn.noDefaultExcludes = true
+			continue
+		}
+		if arg == "--mmap" {
+			toReturn.forceMmap = true
+			continue
+		}
+		if arg == "--no-mmap" {
+			toReturn.noMmap = true
+			continue
+		}
+		if (arg == "-x") || (arg == "-I") {
+			if (i + 1) >= len(rawArgs) {
+				return nil, fmt.Errorf("Missing glob pattern after %s", arg)
+			}
+			i++
+			if arg == "-x" {
+				toReturn.excludes = append(toReturn.excludes, rawArgs[i])
+			} else {
+				toReturn.includes = append(toReturn.includes, rawArgs[i])
+			}
+			continue
+		}
+		if arg == "-j" {
+			if (i + 1) >= len(rawArgs) {
+				return nil, fmt.Errorf("Missing worker count after -j")
+			}
+			i++
+			n, convErr := strconv.Atoi(rawArgs[i])
+			if (convErr != nil) || (n < 1) {
+				return nil, fmt.Errorf("Invalid worker count for -j: %s", rawArgs[i])
+			}
+			toReturn.numWorkers = n
+			continue
+		}
+		if (arg == "--color") || strings.HasPrefix(arg, "--color=") {
+			mode := "auto"
+			if arg != "--color" {
+				mode = strings.TrimPrefix(arg, "--color=")
+			}
+			if (mode != "auto") && (mode != "always") && (mode != "never") {
+				return nil, fmt.Errorf("Invalid --color value: %s", mode)
+			}
+			toReturn.colorMode = mode
+			continue
+		}
+		if arg == "-E" {
+			if (i + 1) >= len(rawArgs) {
+				return nil, fmt.Errorf("Missing encoding list after -E")
+			}
+			i++
+			toReturn.encodings = append(toReturn.encodings,
+				parseEncodingList(rawArgs[i])...)
+			continue
+		}
+		if (arg == "-A") || (arg == "-B") || (arg == "-C") {
+			if (i + 1) >= len(rawArgs) {
+				return nil, fmt.Errorf("Missing line count after %s", arg)
+			}
+			i++
+			n, convErr := strconv.Atoi(rawArgs[i])
+			if (convErr != nil) || (n < 0) {
+				return nil, fmt.Errorf("Invalid line count for %s: %s", arg, rawArgs[i])
+			}
+			switch arg {
+			case "-A":
+				toReturn.afterContext = n
+			case "-B":
+				toReturn.beforeContext = n
+			case "-C":
+				toReturn.beforeContext = n
+				toReturn.afterContext = n
+			}
+			continue
+		}
+		if arg == "-e" {
+			if (i + 1) >= len(rawArgs) {
+				return nil, fmt.Errorf("Missing regular expression after -e")
+			}
+			i++
+			toReturn.patternSpecs = append(toReturn.patternSpecs,
+				patternSpec{fixed: false, text: rawArgs[i]})
+			toReturn.explicitPatterns = true
+			continue
+		}
+		if (arg == "-F") || (arg == "-Q") {
+			if (i + 1) >= len(rawArgs) {
+				return nil, fmt.Errorf("Missing literal string after %s", arg)
+			}
+			i++
+			toReturn.patternSpecs = append(toReturn.patternSpecs,
+				patternSpec{fixed: true, text: rawArgs[i]})
+			toReturn.explicitPatterns = true
+			continue
+		}
+		if arg == "-f" {
+			if (i + 1) >= len(rawArgs) {
+				return nil, fmt.Errorf("Missing pattern file path after -f")
+			}
+			i++
+			fileSpecs, readErr := readPatternsFile(rawArgs[i])
+			if readErr != nil {
+				return nil, readErr
+			}
+			toReturn.patternSpecs = append(toReturn.patternSpecs, fileSpecs...)
+			toReturn.explicitPatterns = true
+			continue
+		}
 		if !strings.HasPrefix(arg, "-") {
-			// The regex will be compiled later, depends on the insensitive
-			// flag.
-			toReturn.expression = arg
-			pathIndex = i + 2
+			if toReturn.explicitPatterns {
+				// No positional pattern argument once -e/-F/-Q/-f is used;
+				// everything from here on is a file path.
+				pathIndex = i + 1
+			} else {
+				// The regex will be compiled later, depends on the
+				// insensitive flag.
+				toReturn.patternSpecs = append(toReturn.patternSpecs,
+					patternSpec{fixed: false, text: arg})
+				pathIndex = i + 2
+			}
 			break
 		}
 		matchedFlags := flagsRegex.FindStringSubmatch(arg)
@@ -67,15 +213,17 @@ func parseArgs() (*options, error) {
 				toReturn.showFilenames = true
 			case 'a':
 				toReturn.binaryAsText = true
+			case 'n':
+				toReturn.lineNumbers = true
 			}
 		}
 	}
-	if pathIndex < 0 {
+	if len(toReturn.patternSpecs) == 0 {
 		return nil, fmt.Errorf("No regular expression was provided.")
 	}
 	toReturn.paths = make([]string, 0, 16)
 	var pathMatches []string
-	for pathIndex < len(os.Args) {
+	for (pathIndex >= 0) && (pathIndex < len(os.Args)) {
 		pathMatches, e = filepath.Glob(os.Args[pathIndex])
 		if e != nil {
 			return nil, fmt.Errorf("Invalid file path: %s", e)
@@ -84,6 +232,19 @@ func parseArgs() (*options, error) {
 		pathIndex++
 	}
 	sort.Strings(toReturn.paths)
+	excludePatterns := toReturn.excludes
+	if !toReturn.noDefaultExcludes {
+		excludePatterns = append(append([]string{}, defaultExcludeGlobs()...),
+			excludePatterns...)
+	}
+	toReturn.excludeGlobs, e = compileGlobs(excludePatterns)
+	if e != nil {
+		return nil, fmt.Errorf("Invalid exclude pattern: %s", e)
+	}
+	toReturn.includeGlobs, e = compileGlobs(toReturn.includes)
+	if e != nil {
+		return nil, fmt.Errorf("Invalid include pattern: %s", e)
+	}
 	return &toReturn, nil
 }
 
@@ -134,8 +295,18 @@ func doDirectoryWalk(args *options) error {
 				}
 				return nil
 			}
-			// Don't append directories to the list of files.
+			// Don't append directories to the list of files. Excluded
+			// directories are pruned entirely, so their contents never get
+			// walked.
 			if info.IsDir() {
+				if args.isExcluded(child) {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			// Include globs only ever apply to files, never to directory
+			// descent.
+			if args.isExcluded(child) || !args.isIncluded(child) {
 				return nil
 			}
 			newPaths[child] = true
@@ -155,155 +326,49 @@ func doDirectoryWalk(args *options) error {
 	return nil
 }
 
-// Returns s with a trailing newline removed, if it had a newline.
-func chomp(s []byte) []byte {
-	if len(s) < 1 {
-		return s
-	}
-	if s[len(s)-1] == '\n' {
-		s = s[0 : len(s)-1]
-	}
-	if len(s) < 1 {
-		return s
-	}
-	if s[len(s)-1] == '\r' {
-		s = s[0 : len(s)-1]
-	}
-	return s
-}
-
-// Checks a single file for matches against the expression. Returns a slice of
-// matched lines, a boolean indicating whether the file is binary, and an error
-// if one occurs.
-func getFileMatches(args *options, regex *regexp.Regexp,
-	file *os.File) ([][]byte, bool, error) {
-	var e error
-	matchedLines := make([][]byte, 0, 100)
-	isBinary := false
-	reader := bufio.NewReader(file)
-	var line, matched []byte
-	for e == nil {
-		line, e = reader.ReadBytes('\n')
-		if (e != nil) && (e != io.EOF) {
-			break
-		}
-		if (e == io.EOF) && (len(line) == 0) {
-			break
-		}
-		line = chomp(line)
-		if bytes.ContainsAny(line, "\x00") {
-			isBinary = true
-		}
-		// If the file is binary and we've already matched something, we can
-		// skip searching the rest of the file.
-		if isBinary && !args.binaryAsText && (len(matchedLines) > 0) {
-			break
-		}
-		matched = regex.Find(line)
-		// If the "inverse" arg was specified, reverse the result so that non-
-		// matching lines are counted as matching.
-		if args.inverse {
-			if matched == nil {
-				matched = line
-			} else {
-				matched = nil
-			}
-		}
-		if matched == nil {
-			continue
-		}
-		if args.onlyMatched {
-			matchedLines = append(matchedLines, matched)
-		} else {
-			matchedLines = append(matchedLines, line)
-		}
-	}
-	if (e != nil) && (e != io.EOF) {
-		return nil, false, fmt.Errorf("Error reading file: %s", e)
-	}
-	return matchedLines, isBinary, nil
-}
-
-// TODO: Scanning from stdin would be better if it were more pipelined.
-func scanStdin(args *options, regex *regexp.Regexp) error {
-	matchedLines, _, e := getFileMatches(args, regex, os.Stdin)
-	if e != nil {
-		return e
-	}
-	for _, line := range matchedLines {
-		if args.hideFilenames {
-			fmt.Printf("%s\n", line)
-		} else {
-			fmt.Printf("(standard input): %s\n", line)
-		}
-	}
-	return nil
-}
-
-// This performs the scanning of each file, using the regular expression. Must
-// be called after doDirectoryWalk.
-func scanFiles(args *options) error {
-	if args.insensitive {
-		args.expression = "(?i)" + args.expression
-	}
-	regex, e := regexp.Compile(args.expression)
-	if e != nil {
-		return fmt.Errorf("Invalid expression: %s", e)
-	}
-	var matchedLines [][]byte
-	isBinary := false
-	var file *os.File
-	// If no paths are given, then use stdin.
-	if len(args.paths) == 0 {
-		return scanStdin(args, regex)
-	}
-	isDir := false
-	for _, path := range args.paths {
-		isDir, e = isDirectory(path)
-		if e != nil {
-			return fmt.Errorf("Error checking if file is directory: %s\n", e)
-		}
-		if isDir {
-			fmt.Printf("Directory: %s\n", path)
-			continue
-		}
-		file, e = os.Open(path)
-		if e != nil {
-			return fmt.Errorf("Error opening file: %s", e)
-		}
-		matchedLines, isBinary, e = getFileMatches(args, regex, file)
-		file.Close()
-		if e != nil {
-			return e
-		}
-		if len(matchedLines) == 0 {
-			continue
-		}
-		if isBinary && !args.binaryAsText {
-			fmt.Printf("Binary file %s matches.\n", path)
-			continue
-		}
-		for _, line := range matchedLines {
-			if args.hideFilenames {
-				fmt.Printf("%s\n", line)
-			} else {
-				fmt.Printf("%s: %s\n", path, line)
-			}
-		}
-	}
-	return nil
-}
-
 func help() {
 	fmt.Printf("This utility provides some of GNU grep's behavior.\n" +
-		"Usage: grep [-irvahHo] <expression> [file paths]\n\n" +
+		"Usage: grep [-irvahHo] [-x glob] [-I glob] [-j N] [-E encodings]\n" +
+		"    <expression> [file paths]\n" +
+		"  grep [-irvahHo] [-e regex]... [-F literal]... [-f patternfile]...\n" +
+		"    [file paths]\n\n" +
 		"  -r: If provided, recursively scan for files in the file paths\n" +
 		"  -i: If provided, use case-insensitive matching\n" +
 		"  -v: If provided, output lines which don't match\n" +
 		"  -a: If provided, treat binary files as text\n" +
 		"  -h: If provided, do not show filenames\n" +
 		"  -H: If provided, always show filenames\n" +
-		"  -o: If provided, only output the part of each line which matched\n")
+		"  -o: If provided, only output the part of each line which matched\n" +
+		"  -x <glob>: Exclude paths matching the given glob (repeatable).\n" +
+		"      Supports *, ?, [...], {a,b}, and /**/ (doublestar) syntax.\n" +
+		"  -I <glob>: Only scan paths matching the given glob (repeatable).\n" +
+		"      Only applies to files, never prunes directory descent.\n" +
+		"      -x and -I only apply to what -r finds while walking directories;\n" +
+		"      files named on the command line are always scanned.\n" +
+		"  --no-default-excludes: Disable the built-in default excludes for\n" +
+		"      VCS directories, swap files, and common build artifacts.\n" +
+		"  -j <N>: Scan using N worker goroutines (default: number of CPUs)\n" +
+		"  -E <list>: Comma-separated encodings to try decoding files as,\n" +
+		"      e.g. utf-8,utf-16le,utf-16be,sjis,euc-jp,iso-2022-jp. A BOM\n" +
+		"      is honored first, except on unseekable input such as a pipe.\n" +
+		"  -n: If provided, prefix each match with its 1-based line number\n" +
+		"  --color[=auto|always|never]: Highlight matches and headers with\n" +
+		"      ANSI colors. auto (the default if just --color is given)\n" +
+		"      only colors output when stdout is a terminal.\n" +
+		"  -e <regex>: Add a regular expression to search for (repeatable).\n" +
+		"      Once given, the positional <expression> is no longer accepted.\n" +
+		"  -F <literal>, -Q <literal>: Add a literal string to search for\n" +
+		"      (repeatable), matched without interpreting regex metacharacters.\n" +
+		"  -f <file>: Add one regular expression per line from a file\n" +
+		"      (repeatable). A line matches if any pattern matches.\n" +
+		"  -A <N>: Print N lines of trailing context after each match.\n" +
+		"  -B <N>: Print N lines of leading context before each match.\n" +
+		"  -C <N>: Print N lines of context both before and after each match.\n" +
+		"      Groups of matches and context are separated by a \"--\" line.\n" +
+		"  --mmap: Memory-map regular files before scanning them regardless\n" +
+		"      of size, unless -E is given or the file starts with a BOM.\n" +
+		"  --no-mmap: Never memory-map files; always read them with a\n" +
+		"      buffered reader, even if they're large.\n")
 	os.Exit(0)
 }
 
@@ -328,6 +393,12 @@ func run() int {
 			args.hideFilenames = true
 		}
 	}
+	switch args.colorMode {
+	case "always":
+		args.useColor = true
+	case "auto":
+		args.useColor = stdoutIsTerminal()
+	}
 	e = scanFiles(args)
 	if e != nil {
 		fmt.Printf("%s\n", e)
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Returns s with a trailing newline removed, if it had a newline.
+func chomp(s []byte) []byte {
+	if len(s) < 1 {
+		return s
+	}
+	if s[len(s)-1] == '\n' {
+		s = s[0 : len(s)-1]
+	}
+	if len(s) < 1 {
+		return s
+	}
+	if s[len(s)-1] == '\r' {
+		s = s[0 : len(s)-1]
+	}
+	return s
+}
+
+// Holds one matched (or, under -v, non-matched) line along with its 1-based
+// line number and the byte-offset spans of every pattern match within text.
+// spans is nil when there's nothing to highlight, which is always the case
+// under -v since the whole line is the "match".
+type matchedLine struct {
+	number int
+	text   []byte
+	spans  [][]int
+}
+
+// Checks a single file for matches against any of the given patterns.
+// Returns a slice of matchedLine, a boolean indicating whether the file is
+// binary, and an error if one occurs. For regular files that tryMmapForFile
+// accepts (by default, those of at least mmapSizeThreshold bytes), this mmaps
+// the file and scans the mapping directly rather than going through a
+// bufio.Reader.
+func getFileMatches(args *options, patterns []compiledPattern,
+	file *os.File) ([]matchedLine, bool, error) {
+	if data, ok := tryMmapForFile(args, file); ok {
+		lines, isBinary, e := getMappedFileMatches(args, patterns, data)
+		munmapFile(data)
+		return lines, isBinary, e
+	}
+	src, e := wrapDecodedReader(args, file)
+	if e != nil {
+		return nil, false, fmt.Errorf("Error detecting file encoding: %s", e)
+	}
+	return scanLineSource(args, patterns, &bufioLineSource{reader: bufio.NewReader(src)})
+}
+
+// Scans an mmap'd file's contents for matches. The returned matchedLines'
+// text fields are copied out of data before returning, since data is
+// unmapped as soon as the caller (getFileMatches) gets its result back.
+func getMappedFileMatches(args *options, patterns []compiledPattern,
+	data []byte) ([]matchedLine, bool, error) {
+	var lines []matchedLine
+	var isBinary bool
+	var e error
+	if mmapLooksBinary(data) && !args.binaryAsText {
+		lines, isBinary, e = scanBinaryMapping(args, patterns, data)
+	} else {
+		lines, isBinary, e = scanLineSource(args, patterns, &byteLineSource{data: data})
+	}
+	if e != nil {
+		return nil, false, e
+	}
+	for i := range lines {
+		if lines[i].text == nil {
+			continue
+		}
+		owned := make([]byte, len(lines[i].text))
+		copy(owned, lines[i].text)
+		lines[i].text = owned
+	}
+	return lines, isBinary, nil
+}
+
+// Scans lines out of src, matching them against patterns and assembling the
+// resulting matchedLine slice, including before/after context handling.
+// This is shared by both the bufio.Reader path and the mmap path, which
+// only differ in how they produce individual lines.
+func scanLineSource(args *options, patterns []compiledPattern, src lineSource) (
+	[]matchedLine, bool, error) {
+	matchedLines := make([]matchedLine, 0, 100)
+	isBinary := false
+	lineNum := 0
+	// Ring buffer of the last beforeContext lines seen that haven't been
+	// emitted yet, in case the next match needs them as leading context.
+	beforeBuf := make([]matchedLine, 0, args.beforeContext)
+	afterRemaining := 0
+	lastEmitted := 0
+	for {
+		line, e := src.next()
+		if e == io.EOF {
+			break
+		}
+		if e != nil {
+			return nil, false, fmt.Errorf("Error reading file: %s", e)
+		}
+		lineNum++
+		if bytes.ContainsAny(line, "\x00") {
+			isBinary = true
+		}
+		// If the file is binary and we've already matched something, we can
+		// skip searching the rest of the file.
+		if isBinary && !args.binaryAsText && (len(matchedLines) > 0) {
+			break
+		}
+		spans := findAllPatternSpans(patterns, line)
+		matched := len(spans) > 0
+		// If the "inverse" arg was specified, reverse the result so that non-
+		// matching lines are counted as matching. There's nothing sensible to
+		// highlight in that case.
+		if args.inverse {
+			matched = !matched
+			spans = nil
+		}
+		if matched {
+			// Emit any buffered "before" context that hasn't already been
+			// emitted as "after" context from a previous match, so adjacent
+			// or overlapping context ranges don't get duplicated.
+			for _, buffered := range beforeBuf {
+				if buffered.number <= lastEmitted {
+					continue
+				}
+				matchedLines = append(matchedLines, buffered)
+				lastEmitted = buffered.number
+			}
+			beforeBuf = beforeBuf[:0]
+			matchedLines = append(matchedLines, matchedLine{
+				number: lineNum,
+				text:   line,
+				spans:  spans,
+			})
+			lastEmitted = lineNum
+			afterRemaining = args.afterContext
+			continue
+		}
+		if afterRemaining > 0 {
+			matchedLines = append(matchedLines, matchedLine{number: lineNum, text: line})
+			lastEmitted = lineNum
+			afterRemaining--
+			continue
+		}
+		if args.beforeContext > 0 {
+			beforeBuf = append(beforeBuf, matchedLine{number: lineNum, text: line})
+			if len(beforeBuf) > args.beforeContext {
+				beforeBuf = beforeBuf[1:]
+			}
+		}
+	}
+	return matchedLines, isBinary, nil
+}
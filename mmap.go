@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+)
+
+// Unless --mmap is given, files smaller than this are read through the
+// normal bufio.Reader path; mmap only pays for itself on larger inputs.
+const mmapSizeThreshold = 64 * 1024
+
+// How many leading bytes of a mapping to check for NUL bytes when deciding
+// whether a mmap'd file is binary, so binary-detection doesn't require
+// scanning (or line-splitting) the whole mapping first.
+const mmapBinarySniffWindow = 8000
+
+// A lineSource yields chomped lines one at a time. A final line that has no
+// trailing newline is returned with a nil error like any other; once there's
+// nothing left to read, next returns a nil line and io.EOF.
+type lineSource interface {
+	next() ([]byte, error)
+}
+
+// Reads lines out of a bufio.Reader, used for the normal (non-mmap) path.
+type bufioLineSource struct {
+	reader *bufio.Reader
+	eof    bool
+}
+
+func (s *bufioLineSource) next() ([]byte, error) {
+	if s.eof {
+		return nil, io.EOF
+	}
+	line, e := s.reader.ReadBytes('\n')
+	if (e != nil) && (e != io.EOF) {
+		return nil, e
+	}
+	if e == io.EOF {
+		s.eof = true
+		if len(line) == 0 {
+			return nil, io.EOF
+		}
+	}
+	return chomp(line), nil
+}
+
+// Reads lines directly out of a byte slice by splitting on '\n', used for
+// the mmap fast path. Doesn't allocate per line.
+type byteLineSource struct {
+	data []byte
+	pos  int
+}
+
+func (s *byteLineSource) next() ([]byte, error) {
+	if s.pos >= len(s.data) {
+		return nil, io.EOF
+	}
+	rest := s.data[s.pos:]
+	i := bytes.IndexByte(rest, '\n')
+	var line []byte
+	if i < 0 {
+		line = rest
+		s.pos = len(s.data)
+	} else {
+		line = rest[:i]
+		s.pos += i + 1
+	}
+	return chomp(line), nil
+}
+
+// Decides whether file should be scanned via mmap given the current
+// options, mapping and returning it if so. ok is false whenever mmap isn't
+// applicable or available, in which case callers should fall back to the
+// normal bufio.Reader path.
+func tryMmapForFile(args *options, file *os.File) (data []byte, ok bool) {
+	if args.noMmap || (file == os.Stdin) {
+		return nil, false
+	}
+	// Transcoding needs to run through wrapDecodedReader's io.Reader chain,
+	// so mmap is only used when no encoding handling was requested.
+	if len(args.encodings) > 0 {
+		return nil, false
+	}
+	info, e := file.Stat()
+	if (e != nil) || !info.Mode().IsRegular() {
+		return nil, false
+	}
+	size := info.Size()
+	if size <= 0 {
+		return nil, false
+	}
+	if !args.forceMmap && (size < mmapSizeThreshold) {
+		return nil, false
+	}
+	// A leading BOM must be honored the same way regardless of file size,
+	// which needs wrapDecodedReader's io.Reader chain; fall back rather than
+	// serve the raw, BOM-prefixed bytes straight out of the mapping.
+	if hasBOM, e := fileStartsWithBOM(file); (e != nil) || hasBOM {
+		return nil, false
+	}
+	return tryMmapFile(file, size)
+}
+
+// Reports whether an early window of a mmap'd file's contents contains a
+// NUL byte, used as a cheap upfront binary check that avoids splitting a
+// huge binary blob into lines just to find out it's binary.
+func mmapLooksBinary(data []byte) bool {
+	n := len(data)
+	if n > mmapBinarySniffWindow {
+		n = mmapBinarySniffWindow
+	}
+	return bytes.IndexByte(data[:n], 0) >= 0
+}
+
+// Handles files that mmapLooksBinary already flagged as binary. Rather than
+// collecting matchedLines, it stops at the first line with any pattern
+// match, which is all "Binary file %s matches." output needs. Lines are
+// matched one at a time, as on the bufio.Reader path, so "^" and "$" anchor
+// at line boundaries. Under -v it defers to scanLineSource instead.
+func scanBinaryMapping(args *options, patterns []compiledPattern, data []byte) (
+	[]matchedLine, bool, error) {
+	if args.inverse {
+		return scanLineSource(args, patterns, &byteLineSource{data: data})
+	}
+	src := &byteLineSource{data: data}
+	for {
+		line, e := src.next()
+		if e != nil {
+			break
+		}
+		if len(findAllPatternSpans(patterns, line)) > 0 {
+			return []matchedLine{{number: 1}}, true, nil
+		}
+	}
+	return nil, true, nil
+}
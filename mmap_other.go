@@ -0,0 +1,15 @@
+//go:build !unix
+
+package main
+
+import (
+	"os"
+)
+
+// mmap isn't implemented on this platform, so always fall back to the
+// bufio.Reader path.
+func tryMmapFile(file *os.File, size int64) ([]byte, bool) {
+	return nil, false
+}
+
+func munmapFile(data []byte) {}
@@ -0,0 +1,25 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// Attempts to memory-map file for reading size bytes starting at offset 0.
+// Returns ok=false (rather than an error) if mmap isn't usable here, so
+// callers can silently fall back to the normal read path.
+func tryMmapFile(file *os.File, size int64) ([]byte, bool) {
+	data, e := syscall.Mmap(int(file.Fd()), 0, int(size), syscall.PROT_READ,
+		syscall.MAP_SHARED)
+	if e != nil {
+		return nil, false
+	}
+	return data, true
+}
+
+// Unmaps a mapping previously returned by tryMmapFile.
+func munmapFile(data []byte) {
+	syscall.Munmap(data)
+}
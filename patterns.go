@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"unicode"
+	"unicode/utf8"
+)
+
+// A single pattern as given on the command line, before compilation. fixed
+// is true for patterns added via -F/-Q, and false for patterns added via
+// -e, -f, or the legacy positional expression argument.
+type patternSpec struct {
+	fixed bool
+	text  string
+}
+
+// A compiled pattern, ready to search lines with. For fixed patterns,
+// exactly one of literal (case-sensitive) or foldNeedle (case-insensitive)
+// is populated; non-fixed patterns use regex instead.
+type compiledPattern struct {
+	fixed      bool
+	literal    []byte
+	foldNeedle []rune
+	regex      *regexp.Regexp
+}
+
+// Returns the start/end byte offsets of every non-overlapping occurrence of
+// needle in haystack.
+func fixedFindAllIndex(haystack, needle []byte) [][]int {
+	if len(needle) == 0 {
+		return nil
+	}
+	var spans [][]int
+	offset := 0
+	for {
+		i := bytes.Index(haystack[offset:], needle)
+		if i < 0 {
+			break
+		}
+		start := offset + i
+		end := start + len(needle)
+		spans = append(spans, []int{start, end})
+		offset = end
+	}
+	return spans
+}
+
+// Returns the start/end byte offsets of every non-overlapping,
+// case-insensitive occurrence of needle (given as already-lower-cased
+// runes) in haystack. Unlike lower-casing the whole haystack up front, this
+// walks haystack's own bytes rune by rune, so returned offsets always refer
+// to the original text even when folding a rune's case changes its byte
+// length (e.g. the two-byte U+0130 lower-cases to the one-byte "i").
+func foldedFixedFindAllIndex(haystack []byte, needle []rune) [][]int {
+	if len(needle) == 0 {
+		return nil
+	}
+	var spans [][]int
+	n := len(haystack)
+	for i := 0; i < n; {
+		pos := i
+		matched := true
+		for _, want := range needle {
+			if pos >= n {
+				matched = false
+				break
+			}
+			r, size := utf8.DecodeRune(haystack[pos:])
+			if unicode.ToLower(r) != want {
+				matched = false
+				break
+			}
+			pos += size
+		}
+		if matched {
+			spans = append(spans, []int{i, pos})
+			i = pos
+			continue
+		}
+		_, size := utf8.DecodeRune(haystack[i:])
+		if size <= 0 {
+			size = 1
+		}
+		i += size
+	}
+	return spans
+}
+
+// Returns s as a slice of its runes, each lower-cased, for use as a
+// foldedFixedFindAllIndex needle.
+func foldRunes(s string) []rune {
+	runes := []rune(s)
+	for i, r := range runes {
+		runes[i] = unicode.ToLower(r)
+	}
+	return runes
+}
+
+// Returns the start/end byte offsets of every match of p within line.
+func (p *compiledPattern) findAllIndex(line []byte) [][]int {
+	if !p.fixed {
+		return p.regex.FindAllIndex(line, -1)
+	}
+	if p.foldNeedle != nil {
+		return foldedFixedFindAllIndex(line, p.foldNeedle)
+	}
+	return fixedFindAllIndex(line, p.literal)
+}
+
+// Compiles the raw pattern specs in order, applying case-insensitivity to
+// each if requested. Regex specs are compiled with regexp.Compile (prefixed
+// with "(?i)" when insensitive); fixed specs are matched with bytes.Index
+// when case-sensitive, or with foldedFixedFindAllIndex's rune-by-rune
+// folding when insensitive, so neither needs compiling.
+func compilePatternSpecs(specs []patternSpec, insensitive bool) ([]compiledPattern,
+	error) {
+	compiled := make([]compiledPattern, 0, len(specs))
+	for _, spec := range specs {
+		if spec.fixed {
+			cp := compiledPattern{fixed: true}
+			if insensitive {
+				cp.foldNeedle = foldRunes(spec.text)
+			} else {
+				cp.literal = []byte(spec.text)
+			}
+			compiled = append(compiled, cp)
+			continue
+		}
+		exprText := spec.text
+		if insensitive {
+			exprText = "(?i)" + exprText
+		}
+		re, e := regexp.Compile(exprText)
+		if e != nil {
+			return nil, fmt.Errorf("Invalid expression %q: %s", spec.text, e)
+		}
+		compiled = append(compiled, compiledPattern{regex: re})
+	}
+	return compiled, nil
+}
+
+// Reads one pattern per line from the file at path, skipping blank lines.
+// Used to implement -f.
+func readPatternsFile(path string) ([]patternSpec, error) {
+	file, e := os.Open(path)
+	if e != nil {
+		return nil, fmt.Errorf("Error opening pattern file: %s", e)
+	}
+	defer file.Close()
+	var specs []patternSpec
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		specs = append(specs, patternSpec{fixed: false, text: line})
+	}
+	if e = scanner.Err(); e != nil {
+		return nil, fmt.Errorf("Error reading pattern file: %s", e)
+	}
+	return specs, nil
+}
+
+// Returns the union of every span produced by patterns against line, sorted
+// by starting offset with overlapping or adjacent spans merged together so
+// callers can iterate them without worrying about overlap.
+func findAllPatternSpans(patterns []compiledPattern, line []byte) [][]int {
+	var spans [][]int
+	for i := range patterns {
+		spans = append(spans, patterns[i].findAllIndex(line)...)
+	}
+	return mergeSpans(spans)
+}
+
+// Sorts spans by start offset and merges any that overlap or touch.
+func mergeSpans(spans [][]int) [][]int {
+	if len(spans) < 2 {
+		return spans
+	}
+	sort.Slice(spans, func(i, j int) bool {
+		if spans[i][0] != spans[j][0] {
+			return spans[i][0] < spans[j][0]
+		}
+		return spans[i][1] < spans[j][1]
+	})
+	merged := make([][]int, 0, len(spans))
+	cur := spans[0]
+	for _, s := range spans[1:] {
+		if s[0] <= cur[1] {
+			if s[1] > cur[1] {
+				cur[1] = s[1]
+			}
+			continue
+		}
+		merged = append(merged, cur)
+		cur = s
+	}
+	merged = append(merged, cur)
+	return merged
+}
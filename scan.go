@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"sync"
+)
+
+// TODO: Scanning from stdin would be better if it were more pipelined.
+func scanStdin(args *options, patterns []compiledPattern) error {
+	matchedLines, _, e := getFileMatches(args, patterns, os.Stdin)
+	if e != nil {
+		return e
+	}
+	printMatchedLines(args, "(standard input)", matchedLines)
+	return nil
+}
+
+// Holds the outcome of scanning a single entry in args.paths, tagged with
+// its index in that slice so results can be reassembled in order regardless
+// of which worker finished first.
+type fileResult struct {
+	index        int
+	path         string
+	isDirectory  bool
+	skipped      bool
+	matchedLines []matchedLine
+	isBinary     bool
+	err          error
+}
+
+// Scans the single file at args.paths[index], returning a fileResult
+// describing the outcome. Safe to call concurrently from multiple workers,
+// since each call only touches its own path.
+func scanOneFile(args *options, patterns []compiledPattern, index int) fileResult {
+	path := args.paths[index]
+	result := fileResult{index: index, path: path}
+	isDir, e := isDirectory(path)
+	if e != nil {
+		result.err = fmt.Errorf("Error checking if file is directory: %s", e)
+		return result
+	}
+	if isDir {
+		result.isDirectory = true
+		return result
+	}
+	// Excludes/includes are already applied by doDirectoryWalk while
+	// descending directories; paths named explicitly on the command line
+	// should always be scanned even if they'd match a default exclude.
+	file, e := os.Open(path)
+	if e != nil {
+		result.err = fmt.Errorf("Error opening file: %s", e)
+		return result
+	}
+	result.matchedLines, result.isBinary, e = getFileMatches(args, patterns, file)
+	file.Close()
+	if e != nil {
+		result.err = e
+	}
+	return result
+}
+
+// Prints the outcome of scanning a single file, matching the formatting
+// scanFiles has always used.
+func printFileResult(args *options, r fileResult) {
+	if r.isDirectory {
+		fmt.Printf("Directory: %s\n", r.path)
+		return
+	}
+	if r.skipped || (len(r.matchedLines) == 0) {
+		return
+	}
+	if r.isBinary && !args.binaryAsText {
+		fmt.Printf("Binary file %s matches.\n", r.path)
+		return
+	}
+	printMatchedLines(args, r.path, r.matchedLines)
+}
+
+// Consumes fileResults as they arrive on the results channel, printing them
+// in ascending path-index order regardless of completion order, buffering
+// out-of-order results in a small map keyed by index. Drains the channel
+// completely even after the first error, so that scanFilesParallel's
+// workers never block trying to send a result nobody is reading.
+func printResultsInOrder(args *options, results <-chan fileResult,
+	total int) error {
+	buffer := make(map[int]fileResult, 8)
+	var firstErr error
+	next := 0
+	for received := 0; received < total; received++ {
+		r := <-results
+		buffer[r.index] = r
+		for {
+			pending, ok := buffer[next]
+			if !ok {
+				break
+			}
+			delete(buffer, next)
+			next++
+			if firstErr != nil {
+				continue
+			}
+			if pending.err != nil {
+				firstErr = pending.err
+				continue
+			}
+			printFileResult(args, pending)
+		}
+	}
+	return firstErr
+}
+
+// Scans every entry in args.paths using a pool of worker goroutines (sized
+// by args.numWorkers, or runtime.NumCPU() if unset), and prints the results
+// in the same order a serial scan would have produced.
+func scanFilesParallel(args *options, patterns []compiledPattern) error {
+	numWorkers := args.numWorkers
+	if numWorkers <= 0 {
+		numWorkers = runtime.NumCPU()
+	}
+	if numWorkers > len(args.paths) {
+		numWorkers = len(args.paths)
+	}
+	if numWorkers < 1 {
+		numWorkers = 1
+	}
+	jobs := make(chan int)
+	results := make(chan fileResult)
+	var workers sync.WaitGroup
+	workers.Add(numWorkers)
+	for w := 0; w < numWorkers; w++ {
+		go func() {
+			defer workers.Done()
+			for index := range jobs {
+				results <- scanOneFile(args, patterns, index)
+			}
+		}()
+	}
+	go func() {
+		workers.Wait()
+		close(results)
+	}()
+	go func() {
+		for i := range args.paths {
+			jobs <- i
+		}
+		close(jobs)
+	}()
+	return printResultsInOrder(args, results, len(args.paths))
+}
+
+// This performs the scanning of each file, using the regular expression. Must
+// be called after doDirectoryWalk.
+func scanFiles(args *options) error {
+	patterns, e := compilePatternSpecs(args.patternSpecs, args.insensitive)
+	if e != nil {
+		return e
+	}
+	// If no paths are given, then use stdin.
+	if len(args.paths) == 0 {
+		return scanStdin(args, patterns)
+	}
+	return scanFilesParallel(args, patterns)
+}